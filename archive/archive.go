@@ -0,0 +1,358 @@
+// Package archive reads and writes price rows in the various archive and
+// document formats the API accepts, so adding a new format only means
+// implementing Format and registering it in FormatFor.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Row is a single price record as it flows through ingestion (Extract) or
+// export (Pack). ID is only meaningful for Pack, where it carries the
+// database primary key; Extract leaves it zero since new rows don't have
+// one yet.
+type Row struct {
+	ID         int
+	ProductID  int
+	Name       string
+	Category   string
+	Price      float64
+	CreateDate time.Time
+}
+
+// RowError describes one CSV record that failed validation during Extract.
+type RowError struct {
+	Line   int    `json:"line"`
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Extractor reads price rows out of an archive or raw document. Rows that
+// fail validation are reported as RowErrors rather than being silently
+// dropped; err is only set when the archive itself couldn't be read (e.g.
+// missing data.csv).
+type Extractor interface {
+	Extract(r io.Reader) (rows []Row, errs []RowError, err error)
+}
+
+// Packer writes price rows into an archive or raw document.
+type Packer interface {
+	Pack(w io.Writer, rows []Row) error
+}
+
+// Format is a pluggable archive or document representation supporting both
+// upload ingestion and export.
+type Format interface {
+	Extractor
+	Packer
+}
+
+// FormatFor resolves the `?format=` query value to a concrete Format. Empty
+// defaults to zip for backward compatibility with the original API.
+func FormatFor(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "zip":
+		return zipFormat{}, nil
+	case "tar":
+		return tarFormat{}, nil
+	case "tgz", "tar.gz":
+		return tgzFormat{}, nil
+	case "csv":
+		return csvFormat{}, nil
+	case "json":
+		return jsonFormat{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", name)
+	}
+}
+
+// ContentTypeAndFilename returns the HTTP content type and, for formats
+// downloaded as a file, the attachment filename for a `?format=` value. An
+// empty filename means the format is meant to be rendered inline rather than
+// downloaded.
+func ContentTypeAndFilename(format string) (string, string) {
+	switch strings.ToLower(format) {
+	case "csv":
+		return "text/csv", "prices.csv"
+	case "tar":
+		return "application/x-tar", "prices.tar"
+	case "tgz", "tar.gz":
+		return "application/gzip", "prices.tar.gz"
+	case "json":
+		return "application/json", ""
+	default:
+		return "application/zip", "prices.zip"
+	}
+}
+
+const csvDataFile = "data.csv"
+
+// validateRow parses and validates one CSV record using the layout the
+// original template shipped: product_id, name, category, an unused column,
+// price, create_date. It returns either a usable Row or a RowError
+// describing the first problem found.
+func validateRow(line int, record []string) (Row, *RowError) {
+	if len(record) < 6 {
+		return Row{}, &RowError{Line: line, Value: strings.Join(record, ","), Reason: fmt.Sprintf("expected at least 6 columns, got %d", len(record))}
+	}
+
+	productID, err := strconv.Atoi(record[0])
+	if err != nil {
+		return Row{}, &RowError{Line: line, Column: "product_id", Value: record[0], Reason: "not an integer"}
+	}
+
+	name := strings.TrimSpace(record[1])
+	if name == "" {
+		return Row{}, &RowError{Line: line, Column: "name", Value: record[1], Reason: "must not be empty"}
+	}
+
+	category := strings.TrimSpace(record[2])
+	if category == "" {
+		return Row{}, &RowError{Line: line, Column: "category", Value: record[2], Reason: "must not be empty"}
+	}
+
+	price, err := strconv.ParseFloat(record[4], 64)
+	if err != nil {
+		return Row{}, &RowError{Line: line, Column: "price", Value: record[4], Reason: "not numeric"}
+	}
+	if price < 0 {
+		return Row{}, &RowError{Line: line, Column: "price", Value: record[4], Reason: "must not be negative"}
+	}
+
+	date, err := time.Parse("2006-01-02", record[5])
+	if err != nil {
+		return Row{}, &RowError{Line: line, Column: "create_date", Value: record[5], Reason: "unparseable date"}
+	}
+
+	return Row{
+		ProductID:  productID,
+		Name:       name,
+		Category:   category,
+		Price:      price,
+		CreateDate: date,
+	}, nil
+}
+
+// maxConsecutiveReadErrors bounds how many times in a row readCSVRows will
+// tolerate reader.Read failing before giving up. A single malformed record
+// only ever produces one error, so a run this long means the underlying
+// reader itself is broken (e.g. a truncated archive member) and would
+// otherwise return the same error forever.
+const maxConsecutiveReadErrors = 50
+
+func readCSVRows(r io.Reader) ([]Row, []RowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	_, _ = reader.Read() // skip header row
+
+	var rows []Row
+	var rowErrors []RowError
+	line := 1
+	consecutiveReadErrors := 0
+
+	for {
+		line++
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Reason: err.Error()})
+			consecutiveReadErrors++
+			if consecutiveReadErrors >= maxConsecutiveReadErrors {
+				return nil, nil, fmt.Errorf("aborting after %d consecutive CSV read errors at line %d: %w", consecutiveReadErrors, line, err)
+			}
+			continue
+		}
+		consecutiveReadErrors = 0
+		row, rowErr := validateRow(line, record)
+		if rowErr != nil {
+			rowErrors = append(rowErrors, *rowErr)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// writeCSVRows writes rows in the same column layout validateRow reads
+// (product_id, name, category, id, price, create_date) so that packing a
+// format and extracting it back round-trips every field but ID, exactly as
+// documented on Row.
+func writeCSVRows(w io.Writer, rows []Row) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write([]string{"product_id", "name", "category", "id", "price", "create_date"}); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := []string{
+			strconv.Itoa(row.ProductID),
+			row.Name,
+			row.Category,
+			strconv.Itoa(row.ID),
+			fmt.Sprintf("%.2f", row.Price),
+			row.CreateDate.Format("2006-01-02"),
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+type csvFormat struct{}
+
+func (csvFormat) Extract(r io.Reader) ([]Row, []RowError, error) {
+	return readCSVRows(r)
+}
+
+func (csvFormat) Pack(w io.Writer, rows []Row) error {
+	return writeCSVRows(w, rows)
+}
+
+type zipFormat struct{}
+
+func (zipFormat) Extract(r io.Reader) ([]Row, []RowError, error) {
+	tmp, err := os.CreateTemp("", "prices-upload-*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	zipReader, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csvFile := findCSV(zipReader)
+	if csvFile == nil {
+		return nil, nil, fmt.Errorf("%s not found in ZIP", csvDataFile)
+	}
+
+	f, err := csvFile.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return readCSVRows(f)
+}
+
+func (zipFormat) Pack(w io.Writer, rows []Row) error {
+	zipWriter := zip.NewWriter(w)
+	zipFile, err := zipWriter.Create(csvDataFile)
+	if err != nil {
+		return err
+	}
+	if err := writeCSVRows(zipFile, rows); err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+func findCSV(zr *zip.Reader) *zip.File {
+	for _, file := range zr.File {
+		if strings.HasSuffix(file.Name, csvDataFile) {
+			return file
+		}
+	}
+	return nil
+}
+
+type tarFormat struct{}
+
+func (tarFormat) Extract(r io.Reader) ([]Row, []RowError, error) {
+	return extractTar(tar.NewReader(r))
+}
+
+func (tarFormat) Pack(w io.Writer, rows []Row) error {
+	return packTar(tar.NewWriter(w), rows)
+}
+
+type tgzFormat struct{}
+
+func (tgzFormat) Extract(r io.Reader) ([]Row, []RowError, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+	return extractTar(tar.NewReader(gz))
+}
+
+func (tgzFormat) Pack(w io.Writer, rows []Row) error {
+	gz := gzip.NewWriter(w)
+	if err := packTar(tar.NewWriter(gz), rows); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func extractTar(tr *tar.Reader) ([]Row, []RowError, error) {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("%s not found in archive", csvDataFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasSuffix(header.Name, csvDataFile) {
+			return readCSVRows(tr)
+		}
+	}
+}
+
+func packTar(tw *tar.Writer, rows []Row) error {
+	var buf strings.Builder
+	if err := writeCSVRows(&buf, rows); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: csvDataFile,
+		Mode: 0o644,
+		Size: int64(buf.Len()),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(buf.String())); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// jsonFormat packs rows as a plain JSON array for inline API responses and
+// extracts the same shape back, so uploading the export of a previous GET
+// round-trips without going through CSV.
+type jsonFormat struct{}
+
+func (jsonFormat) Extract(r io.Reader) ([]Row, []RowError, error) {
+	var rows []Row
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, nil, fmt.Errorf("decoding JSON rows: %w", err)
+	}
+	return rows, nil, nil
+}
+
+func (jsonFormat) Pack(w io.Writer, rows []Row) error {
+	return json.NewEncoder(w).Encode(rows)
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestValidateRow(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     []string
+		wantRow    Row
+		wantReason string
+	}{
+		{
+			name:   "valid row",
+			record: []string{"1", "Widget", "Hardware", "unused", "9.99", "2024-01-15"},
+			wantRow: Row{
+				ProductID:  1,
+				Name:       "Widget",
+				Category:   "Hardware",
+				Price:      9.99,
+				CreateDate: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:       "too few columns",
+			record:     []string{"1", "Widget", "Hardware", "unused", "9.99"},
+			wantReason: "expected at least 6 columns, got 5",
+		},
+		{
+			name:       "bad product_id",
+			record:     []string{"not-a-number", "Widget", "Hardware", "unused", "9.99", "2024-01-15"},
+			wantReason: "not an integer",
+		},
+		{
+			name:       "empty name",
+			record:     []string{"1", "  ", "Hardware", "unused", "9.99", "2024-01-15"},
+			wantReason: "must not be empty",
+		},
+		{
+			name:       "empty category",
+			record:     []string{"1", "Widget", " ", "unused", "9.99", "2024-01-15"},
+			wantReason: "must not be empty",
+		},
+		{
+			name:       "non-numeric price",
+			record:     []string{"1", "Widget", "Hardware", "unused", "free", "2024-01-15"},
+			wantReason: "not numeric",
+		},
+		{
+			name:       "negative price",
+			record:     []string{"1", "Widget", "Hardware", "unused", "-1.00", "2024-01-15"},
+			wantReason: "must not be negative",
+		},
+		{
+			name:       "unparseable date",
+			record:     []string{"1", "Widget", "Hardware", "unused", "9.99", "15-01-2024"},
+			wantReason: "unparseable date",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			row, rowErr := validateRow(2, tc.record)
+			if tc.wantReason != "" {
+				if rowErr == nil {
+					t.Fatalf("validateRow(%v) = %+v, nil; want error containing %q", tc.record, row, tc.wantReason)
+				}
+				if rowErr.Reason != tc.wantReason {
+					t.Fatalf("validateRow(%v) reason = %q, want %q", tc.record, rowErr.Reason, tc.wantReason)
+				}
+				if rowErr.Line != 2 {
+					t.Errorf("validateRow(%v) line = %d, want 2", tc.record, rowErr.Line)
+				}
+				return
+			}
+			if rowErr != nil {
+				t.Fatalf("validateRow(%v) = %+v; want no error", tc.record, *rowErr)
+			}
+			if row != tc.wantRow {
+				t.Errorf("validateRow(%v) = %+v, want %+v", tc.record, row, tc.wantRow)
+			}
+		})
+	}
+}
+
+func sampleRows() []Row {
+	return []Row{
+		{ID: 1, ProductID: 101, Name: "Widget", Category: "Hardware", Price: 9.99, CreateDate: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, ProductID: 102, Name: "Gadget", Category: "Electronics", Price: 19.5, CreateDate: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+// TestFormatRoundTrip packs a set of rows and extracts them back for every
+// registered format. CSV-based formats (csv, zip, tar, tgz) all lose ID on
+// the way through, matching the contract documented on Row; jsonFormat
+// preserves it.
+func TestFormatRoundTrip(t *testing.T) {
+	for _, formatName := range []string{"csv", "zip", "tar", "tgz", "json"} {
+		t.Run(formatName, func(t *testing.T) {
+			format, err := FormatFor(formatName)
+			if err != nil {
+				t.Fatalf("FormatFor(%q): %v", formatName, err)
+			}
+
+			rows := sampleRows()
+			var buf bytes.Buffer
+			if err := format.Pack(&buf, rows); err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+
+			gotRows, rowErrors, err := format.Extract(&buf)
+			if err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			if len(rowErrors) != 0 {
+				t.Fatalf("Extract row errors: %+v", rowErrors)
+			}
+			if len(gotRows) != len(rows) {
+				t.Fatalf("Extract returned %d rows, want %d", len(gotRows), len(rows))
+			}
+
+			for i, want := range rows {
+				got := gotRows[i]
+				if formatName != "json" {
+					want.ID = 0
+				}
+				if got != want {
+					t.Errorf("row %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultQuotaRows  = 10000
+	defaultQuotaBytes = 50 << 20 // 50MiB
+)
+
+// User represents a provisioned API account and its upload quotas.
+type User struct {
+	ID         int
+	Email      string
+	QuotaRows  int
+	QuotaBytes int64
+}
+
+type createUserRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type createUserResponse struct {
+	ID         int    `json:"id"`
+	Email      string `json:"email"`
+	QuotaRows  int    `json:"quota_rows"`
+	QuotaBytes int64  `json:"quota_bytes"`
+}
+
+func createUsersTableIfNotExists(db *sql.DB) {
+	query := `
+		CREATE TABLE IF NOT EXISTS users (
+			id SERIAL PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			quota_rows INT NOT NULL DEFAULT 10000,
+			quota_bytes BIGINT NOT NULL DEFAULT 52428800,
+			created_at TIMESTAMP NOT NULL DEFAULT now()
+		)
+	`
+	if _, err := db.Exec(query); err != nil {
+		fatal("error creating users table", "error", err)
+	}
+	logger.Info("table ensured", "table", "users")
+}
+
+func handlePostUsers(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("error decoding user request", "error", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" || req.Password == "" {
+		http.Error(w, "email and password are required", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Error("error hashing password", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var id int
+	err = db.QueryRow(`
+		INSERT INTO users (email, password_hash, quota_rows, quota_bytes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, req.Email, string(hash), defaultQuotaRows, defaultQuotaBytes).Scan(&id)
+	if err != nil {
+		logger.Error("error creating user", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createUserResponse{
+		ID:         id,
+		Email:      req.Email,
+		QuotaRows:  defaultQuotaRows,
+		QuotaBytes: defaultQuotaBytes,
+	})
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+func authenticate(db *sql.DB, email, password string) (*User, error) {
+	var user User
+	var hash string
+	err := db.QueryRow(`
+		SELECT id, email, password_hash, quota_rows, quota_bytes
+		FROM users
+		WHERE email = $1
+	`, email).Scan(&user.ID, &user.Email, &hash, &user.QuotaRows, &user.QuotaBytes)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return &user, nil
+}
+
+// requireAuth wraps an authenticated handler with HTTP Basic auth, rejecting
+// any request that doesn't carry valid user credentials.
+func requireAuth(db *sql.DB, next func(w http.ResponseWriter, r *http.Request, user *User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="prices"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := authenticate(db, email, password)
+		if err != nil {
+			if !errors.Is(err, errInvalidCredentials) {
+				logger.Error("error authenticating user", "error", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="prices"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r, user)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Config holds everything the service needs to start, sourced from
+// environment variables with flag overrides so the same binary runs
+// unmodified on a laptop, in Docker or in Kubernetes.
+type Config struct {
+	DBHost     string
+	DBPort     int
+	DBUser     string
+	DBPassword string
+	DBName     string
+	ListenAddr string
+	LogLevel   string
+	RedisAddr  string
+	Workers    int
+}
+
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		DBHost:     envOr("DB_HOST", "localhost"),
+		DBUser:     envOr("DB_USER", "validator"),
+		DBPassword: envOr("DB_PASSWORD", "val1dat0r"),
+		DBName:     envOr("DB_NAME", "project-sem-1"),
+		ListenAddr: envOr("LISTEN_ADDR", ":8080"),
+		LogLevel:   envOr("LOG_LEVEL", "info"),
+		RedisAddr:  envOr("REDIS_ADDR", "localhost:6379"),
+	}
+	dbPort := envOr("DB_PORT", "5432")
+	workers := envOr("WORKER_COUNT", "4")
+
+	flag.StringVar(&cfg.DBHost, "db-host", cfg.DBHost, "PostgreSQL host")
+	flag.StringVar(&dbPort, "db-port", dbPort, "PostgreSQL port")
+	flag.StringVar(&cfg.DBUser, "db-user", cfg.DBUser, "PostgreSQL user")
+	flag.StringVar(&cfg.DBPassword, "db-password", cfg.DBPassword, "PostgreSQL password")
+	flag.StringVar(&cfg.DBName, "db-name", cfg.DBName, "PostgreSQL database name")
+	flag.StringVar(&cfg.ListenAddr, "listen-addr", cfg.ListenAddr, "HTTP listen address")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level (debug|info|warn|error)")
+	flag.StringVar(&cfg.RedisAddr, "redis-addr", cfg.RedisAddr, "Redis address")
+	flag.StringVar(&workers, "workers", workers, "number of background ingest worker goroutines")
+	flag.Parse()
+
+	port, err := strconv.Atoi(dbPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_PORT/--db-port %q: %w", dbPort, err)
+	}
+	cfg.DBPort = port
+
+	workerCount, err := strconv.Atoi(workers)
+	if err != nil || workerCount < 1 {
+		return nil, fmt.Errorf("invalid WORKER_COUNT/--workers %q: must be a positive integer", workers)
+	}
+	cfg.Workers = workerCount
+
+	if cfg.DBUser == "" || cfg.DBPassword == "" || cfg.DBName == "" {
+		return nil, fmt.Errorf("DB_USER, DB_PASSWORD and DB_NAME (or their --db-* flags) must not be empty")
+	}
+
+	return cfg, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
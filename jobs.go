@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/DSugakov/itmo-devops-sem1-project-template/archive"
+)
+
+const (
+	ingestQueueKey   = "ingest:queue"
+	ingestJobPrefix  = "ingest:job:"
+	ingestHashPrefix = "ingest:"
+	jobResultTTL     = 24 * time.Hour
+)
+
+// JobStatus is the value stored in Redis for a queued ingest job and
+// returned from GET /api/v0/prices/jobs/{id}. UserID is kept out of the
+// JSON response; it only exists so handleGetJob can reject requests from
+// a user other than the one who submitted the job.
+type JobStatus struct {
+	UserID  int                `json:"-"`
+	Status  string             `json:"status"` // pending|running|done|failed|quota_exceeded
+	Result  *InsertResult      `json:"result,omitempty"`
+	Errors  []archive.RowError `json:"errors,omitempty"`
+	Skipped int                `json:"skipped,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// ingestJob is the payload pushed onto the Redis queue; the uploaded
+// archive itself lives on disk at FilePath so the queue entry stays small.
+type ingestJob struct {
+	ID       string `json:"id"`
+	UserID   int    `json:"user_id"`
+	Format   string `json:"format"`
+	FilePath string `json:"file_path"`
+	Strict   bool   `json:"strict"`
+}
+
+func newJobID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func setJobStatus(ctx context.Context, rdb *redis.Client, id string, status JobStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, ingestJobPrefix+id, data, jobResultTTL).Err()
+}
+
+func getJobStatus(ctx context.Context, rdb *redis.Client, id string) (*JobStatus, error) {
+	data, err := rdb.Get(ctx, ingestJobPrefix+id).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var status JobStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// handlePostPricesAsync makes ingestion idempotent and asynchronous: a
+// duplicate upload (by content hash) replays the original job's outcome
+// instead of re-processing it, and a new upload is handed to the worker
+// pool while the request returns immediately.
+func handlePostPricesAsync(db *sql.DB, rdb *redis.Client, w http.ResponseWriter, r *http.Request, user *User) {
+	if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		logger.Error("error parsing form", "error", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		logger.Error("error getting file", "error", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if user.QuotaBytes > 0 && header.Size > user.QuotaBytes {
+		logger.Warn("user exceeded byte quota", "email", user.Email, "size", header.Size, "quota_bytes", user.QuotaBytes)
+		http.Error(w, "Upload Quota Exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if _, err := archive.FormatFor(format); err != nil {
+		logger.Error("error resolving archive format", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "prices-ingest-*")
+	if err != nil {
+		logger.Error("error creating temp file", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), file); err != nil {
+		logger.Error("error staging upload", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	ctx := r.Context()
+	jobID, err := newJobID()
+	if err != nil {
+		logger.Error("error generating job id", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	idemKey := fmt.Sprintf("%s%d:%s", ingestHashPrefix, user.ID, hash)
+	ok, err := rdb.SetNX(ctx, idemKey, jobID, jobResultTTL).Result()
+	if err != nil {
+		logger.Error("error checking idempotency key", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		os.Remove(tmp.Name())
+		existingID, err := rdb.Get(ctx, idemKey).Result()
+		if err != nil {
+			logger.Error("error reading existing job id", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		status, err := getJobStatus(ctx, rdb, existingID)
+		if err != nil {
+			logger.Error("error reading existing job status", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if status.Status == "done" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		respondAccepted(w, existingID, status.Status)
+		return
+	}
+
+	if err := setJobStatus(ctx, rdb, jobID, JobStatus{UserID: user.ID, Status: "pending"}); err != nil {
+		logger.Error("error recording job status", "error", err)
+		abandonJob(ctx, rdb, idemKey, jobID, tmp.Name())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	strict := r.URL.Query().Get("strict") == "true"
+	job := ingestJob{ID: jobID, UserID: user.ID, Format: format, FilePath: tmp.Name(), Strict: strict}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		logger.Error("error encoding job", "error", err)
+		abandonJob(ctx, rdb, idemKey, jobID, tmp.Name())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rdb.LPush(ctx, ingestQueueKey, payload).Err(); err != nil {
+		logger.Error("error enqueueing job", "error", err)
+		abandonJob(ctx, rdb, idemKey, jobID, tmp.Name())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	respondAccepted(w, jobID, "pending")
+}
+
+// abandonJob undoes the bookkeeping handlePostPricesAsync writes before
+// enqueueing: without this, a job that fails to reach the queue would sit
+// "pending" forever and its idempotency key would block every retry of the
+// same upload for jobResultTTL.
+func abandonJob(ctx context.Context, rdb *redis.Client, idemKey, jobID, filePath string) {
+	if err := rdb.Del(ctx, idemKey, ingestJobPrefix+jobID).Err(); err != nil {
+		logger.Error("error cleaning up abandoned job", "job_id", jobID, "error", err)
+	}
+	os.Remove(filePath)
+}
+
+type acceptedJobResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+}
+
+func respondAccepted(w http.ResponseWriter, jobID, status string) {
+	w.Header().Set("Location", "/api/v0/prices/jobs/"+jobID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(acceptedJobResponse{JobID: jobID, Status: status})
+}
+
+func handleGetJob(rdb *redis.Client, w http.ResponseWriter, r *http.Request, user *User) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v0/prices/jobs/")
+	if id == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	status, err := getJobStatus(r.Context(), rdb, id)
+	if errors.Is(err, redis.Nil) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("error reading job status", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Jobs are only visible to the user who submitted them; report a
+	// mismatch the same way as a missing job so IDs can't be enumerated.
+	if status.UserID != user.ID {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// runWorkerPool starts n background workers popping jobs off the Redis
+// queue and ingesting them into Postgres via the COPY-based path.
+func runWorkerPool(ctx context.Context, db *sql.DB, rdb *redis.Client, n int) {
+	for i := 0; i < n; i++ {
+		go ingestWorker(ctx, db, rdb)
+	}
+}
+
+func ingestWorker(ctx context.Context, db *sql.DB, rdb *redis.Client) {
+	for {
+		res, err := rdb.BRPop(ctx, 0, ingestQueueKey).Result()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("error popping ingest job", "error", err)
+			continue
+		}
+
+		// BRPop returns [key, value]; we only queued one list.
+		var job ingestJob
+		if err := json.Unmarshal([]byte(res[1]), &job); err != nil {
+			logger.Error("error decoding ingest job", "error", err)
+			continue
+		}
+
+		processIngestJob(ctx, db, rdb, job)
+	}
+}
+
+func processIngestJob(ctx context.Context, db *sql.DB, rdb *redis.Client, job ingestJob) {
+	defer os.Remove(job.FilePath)
+
+	if err := setJobStatus(ctx, rdb, job.ID, JobStatus{UserID: job.UserID, Status: "running"}); err != nil {
+		logger.Error("error marking job running", "job_id", job.ID, "error", err)
+	}
+
+	user, err := loadUser(db, job.UserID)
+	if err != nil {
+		failJob(ctx, rdb, job.ID, job.UserID, err)
+		return
+	}
+
+	f, err := os.Open(job.FilePath)
+	if err != nil {
+		failJob(ctx, rdb, job.ID, job.UserID, err)
+		return
+	}
+	defer f.Close()
+
+	format, err := archive.FormatFor(job.Format)
+	if err != nil {
+		failJob(ctx, rdb, job.ID, job.UserID, err)
+		return
+	}
+
+	rows, rowErrors, err := format.Extract(f)
+	if err != nil {
+		failJob(ctx, rdb, job.ID, job.UserID, err)
+		return
+	}
+
+	if job.Strict && len(rowErrors) > 0 {
+		status := JobStatus{UserID: job.UserID, Status: "failed", Errors: rowErrors, Skipped: len(rowErrors), Error: fmt.Sprintf("%d row(s) failed validation", len(rowErrors))}
+		if err := setJobStatus(ctx, rdb, job.ID, status); err != nil {
+			logger.Error("error marking job failed", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	result, err := ingestRows(db, user, rows)
+	if errors.Is(err, errQuotaExceeded) {
+		status := JobStatus{UserID: job.UserID, Status: "quota_exceeded", Error: err.Error()}
+		if err := setJobStatus(ctx, rdb, job.ID, status); err != nil {
+			logger.Error("error marking job quota_exceeded", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+	if err != nil {
+		failJob(ctx, rdb, job.ID, job.UserID, err)
+		return
+	}
+
+	if err := setJobStatus(ctx, rdb, job.ID, JobStatus{UserID: job.UserID, Status: "done", Result: result, Errors: rowErrors, Skipped: len(rowErrors)}); err != nil {
+		logger.Error("error marking job done", "job_id", job.ID, "error", err)
+	}
+
+	logger.Info("ingest_job_done",
+		"job_id", job.ID,
+		"user_id", job.UserID,
+		"rows_inserted", result.TotalItems,
+		"rows_skipped", len(rowErrors),
+	)
+}
+
+func failJob(ctx context.Context, rdb *redis.Client, id string, userID int, err error) {
+	logger.Error("ingest job failed", "job_id", id, "error", err)
+	if setErr := setJobStatus(ctx, rdb, id, JobStatus{UserID: userID, Status: "failed", Error: err.Error()}); setErr != nil {
+		logger.Error("error marking job failed", "job_id", id, "error", setErr)
+	}
+}
+
+func loadUser(db *sql.DB, id int) (*User, error) {
+	var user User
+	err := db.QueryRow(`SELECT id, email, quota_rows, quota_bytes FROM users WHERE id = $1`, id).
+		Scan(&user.ID, &user.Email, &user.QuotaRows, &user.QuotaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("loading user %d: %w", id, err)
+	}
+	return &user, nil
+}
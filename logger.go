@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logger is replaced in main() once the configured log level is known, but
+// starts with a sane default so package init and early startup errors still
+// produce JSON output.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+func newLogger(levelName string) *slog.Logger {
+	var level slog.Level
+	switch strings.ToLower(levelName) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytesOut  int
+	wroteCode bool
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.wroteCode = true
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteCode {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytesOut += n
+	return n, err
+}
+
+// withRequestLogging wraps a handler with structured access logging: request
+// ID, method, path, status, duration and byte counts, all as JSON via slog.
+func withRequestLogging(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqID := newRequestID()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(rec, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, reqID)))
+
+		logger.Info("http_request",
+			"request_id", reqID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"bytes_in", r.ContentLength,
+			"bytes_out", rec.bytesOut,
+		)
+	}
+}
+
+type contextKey string
+
+const requestIDContextKey contextKey = "request_id"
+
+func requestIDFrom(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDContextKey).(string); ok {
+		return id
+	}
+	return ""
+}
@@ -1,29 +1,19 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
-)
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 
-const (
-	dbHost     = "localhost"
-	dbPort     = 5432
-	dbUser     = "validator"
-	dbPassword = "val1dat0r"
-	dbName     = "project-sem-1"
+	"github.com/DSugakov/itmo-devops-sem1-project-template/archive"
 )
 
 type InsertResult struct {
@@ -33,33 +23,82 @@ type InsertResult struct {
 }
 
 func main() {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	logger = newLogger(cfg.LogLevel)
+
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
-		log.Fatalf("Database connection error: %v", err)
+		fatal("database connection error", "error", err)
 	}
 	defer db.Close()
 
 	if err := db.Ping(); err != nil {
-		log.Fatalf("Database ping error: %v", err)
+		fatal("database ping error", "error", err)
 	}
 
+	createUsersTableIfNotExists(db)
 	createTableIfNotExists(db)
 
-	http.HandleFunc("/api/v0/prices", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received %s request to /api/v0/prices", r.Method)
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	defer rdb.Close()
+
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	logger.Info("starting ingest worker pool", "workers", cfg.Workers)
+	runWorkerPool(workerCtx, db, rdb, cfg.Workers)
+
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz(db))
+
+	http.HandleFunc("/api/v0/users", withRequestLogging(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
-			handlePostPrices(db, w, r)
+			handlePostUsers(db, w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	http.HandleFunc("/api/v0/prices", withRequestLogging(requireAuth(db, func(w http.ResponseWriter, r *http.Request, user *User) {
+		switch r.Method {
+		case http.MethodPost:
+			handlePostPricesAsync(db, rdb, w, r, user)
 		case http.MethodGet:
-			handleGetPrices(db, w, r)
+			handleGetPrices(db, w, r, user)
 		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	})))
+
+	http.HandleFunc("/api/v0/prices/jobs/", withRequestLogging(requireAuth(db, func(w http.ResponseWriter, r *http.Request, user *User) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleGetJob(rdb, w, r, user)
+	})))
+
+	logger.Info("listening", "addr", cfg.ListenAddr)
+	fatal("server exited", "error", http.ListenAndServe(cfg.ListenAddr, nil))
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
 
-	log.Println("Listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+func handleReadyz(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := db.Ping(); err != nil {
+			logger.Error("readiness check failed", "error", err)
+			http.Error(w, "Not Ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
 func createTableIfNotExists(db *sql.DB) {
@@ -70,223 +109,135 @@ func createTableIfNotExists(db *sql.DB) {
 			name TEXT NOT NULL,
 			category TEXT NOT NULL,
 			price NUMERIC NOT NULL,
-			create_date DATE NOT NULL
+			create_date DATE NOT NULL,
+			uploaded_by INT REFERENCES users(id)
 		)
 	`
 	_, err := db.Exec(query)
 	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+		fatal("error creating prices table", "error", err)
 	}
-	log.Println("Table 'prices' ensured")
+	logger.Info("table ensured", "table", "prices")
 }
 
-func handlePostPrices(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
-		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
-		return
-	}
-
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("Error getting file: %v", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	log.Printf("Received file: %s", header.Filename)
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".zip") {
-		http.Error(w, "File must be a ZIP archive", http.StatusBadRequest)
-		return
-	}
-
-	buf, err := readFileToBytes(file)
-	if err != nil {
-		log.Printf("Error reading file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	zipReader, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
-	if err != nil {
-		log.Printf("Error opening ZIP file: %v", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	csvFile := findCSV(zipReader)
-	if csvFile == nil {
-		log.Println("CSV file not found in ZIP")
-		http.Error(w, "CSV file not found in ZIP", http.StatusBadRequest)
-		return
-	}
+// errQuotaExceeded marks a row-quota rejection so callers (the background
+// ingest worker) can report it as a distinct job status instead of a generic
+// failure.
+var errQuotaExceeded = errors.New("row quota exceeded")
 
+// ingestRows runs the COPY-based bulk insert for an already-extracted set of
+// rows, enforcing the uploading user's row quota. It's called from the
+// background ingest worker once an uploaded archive has been parsed.
+func ingestRows(db *sql.DB, user *User, rows []archive.Row) (*InsertResult, error) {
 	tx, err := db.BeginTx(context.Background(), nil)
 	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error starting transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(context.Background(), `
-		INSERT INTO prices (product_id, name, category, price, create_date)
-		VALUES ($1, $2, $3, $4, $5)
-	`)
-	if err != nil {
-		log.Printf("Error preparing statement: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if user.QuotaRows > 0 {
+		var existingRows int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM prices WHERE uploaded_by = $1`, user.ID).Scan(&existingRows); err != nil {
+			return nil, fmt.Errorf("error checking row quota: %w", err)
+		}
+		if existingRows+len(rows) > user.QuotaRows {
+			return nil, fmt.Errorf("%w: %d + %d > %d", errQuotaExceeded, existingRows, len(rows), user.QuotaRows)
+		}
 	}
-	defer stmt.Close()
 
-	reader, err := openCSVFromZip(csvFile)
+	stmt, err := tx.PrepareContext(context.Background(), pq.CopyIn("prices", "product_id", "name", "category", "price", "create_date", "uploaded_by"))
 	if err != nil {
-		log.Printf("Error opening CSV file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error preparing COPY statement: %w", err)
 	}
+	defer stmt.Close()
 
-	_, _ = reader.Read() // Skip header row
 	inserted := 0
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("Error reading CSV record: %v", err)
-			continue
-		}
-		if len(record) < 6 {
-			log.Printf("Skipping invalid record: %v", record)
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(context.Background(), row.ProductID, row.Name, row.Category, row.Price, row.CreateDate, user.ID); err != nil {
+			logger.Error("error staging record for COPY", "error", err)
 			continue
 		}
+		inserted++
+	}
 
-		productID, _ := strconv.Atoi(record[0])
-		price, _ := strconv.ParseFloat(record[4], 64)
-		date, _ := time.Parse("2006-01-02", record[5])
+	if _, err := stmt.ExecContext(context.Background()); err != nil {
+		return nil, fmt.Errorf("error flushing COPY: %w", err)
+	}
 
-		_, err = stmt.ExecContext(context.Background(), productID, record[1], record[2], price, date)
-		if err != nil {
-			log.Printf("Error inserting record: %v", err)
-			continue
-		}
-		inserted++
+	if err := stmt.Close(); err != nil {
+		return nil, fmt.Errorf("error closing COPY statement: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error committing transaction: %w", err)
 	}
 
-	result, err := getInsertResult(db, inserted)
+	return getInsertResult(db, user.ID, inserted)
+}
+
+func handleGetPrices(db *sql.DB, w http.ResponseWriter, r *http.Request, user *User) {
+	query, args, err := buildPricesQuery(user.ID, r.URL.Query())
 	if err != nil {
-		log.Printf("Error getting result: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		logger.Error("error building filter query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
-}
-
-func handleGetPrices(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-		SELECT id, product_id, name, category, price, create_date
-		FROM prices
-		ORDER BY id ASC
-	`)
+	dbRows, err := db.Query(query, args...)
 	if err != nil {
-		log.Printf("Error querying database: %v", err)
+		logger.Error("error querying database", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	defer dbRows.Close()
 
-	all := [][]string{{"id", "product_id", "name", "category", "price", "create_date"}}
-	for rows.Next() {
-		var id, productID int
-		var name, category string
-		var price float64
-		var createDate time.Time
-
-		if err := rows.Scan(&id, &productID, &name, &category, &price, &createDate); err != nil {
-			log.Printf("Error scanning row: %v", err)
+	var rows []archive.Row
+	for dbRows.Next() {
+		var row archive.Row
+		if err := dbRows.Scan(&row.ID, &row.ProductID, &row.Name, &row.Category, &row.Price, &row.CreateDate); err != nil {
+			logger.Error("error scanning row", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-
-		all = append(all, []string{
-			strconv.Itoa(id),
-			strconv.Itoa(productID),
-			name,
-			category,
-			fmt.Sprintf("%.2f", price),
-			createDate.Format("2006-01-02"),
-		})
+		rows = append(rows, row)
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over rows: %v", err)
+	if err := dbRows.Err(); err != nil {
+		logger.Error("error iterating over rows", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	var csvBuf bytes.Buffer
-	writer := csv.NewWriter(&csvBuf)
-	if err := writer.WriteAll(all); err != nil {
-		log.Printf("Error writing CSV: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	var zipBuf bytes.Buffer
-	zipWriter := zip.NewWriter(&zipBuf)
-	zipFile, err := zipWriter.Create("data.csv")
+	formatName := r.URL.Query().Get("format")
+	format, err := archive.FormatFor(formatName)
 	if err != nil {
-		log.Printf("Error creating ZIP file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	if _, err := zipFile.Write(csvBuf.Bytes()); err != nil {
-		log.Printf("Error writing to ZIP file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		logger.Error("error resolving archive format", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := zipWriter.Close(); err != nil {
-		log.Printf("Error closing ZIP writer: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	contentType, filename := archive.ContentTypeAndFilename(formatName)
+	w.Header().Set("Content-Type", contentType)
+	if filename != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
 	}
-
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", `attachment; filename="prices.zip"`)
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(zipBuf.Bytes()); err != nil {
-		log.Printf("Error writing response: %v", err)
+	if err := format.Pack(w, rows); err != nil {
+		logger.Error("error packing response", "error", err)
 	}
 }
 
-func getInsertResult(db *sql.DB, inserted int) (*InsertResult, error) {
+// getInsertResult summarizes the uploading user's own rows; it must stay
+// scoped to userID so one tenant's POST result never reveals another
+// tenant's totals.
+func getInsertResult(db *sql.DB, userID, inserted int) (*InsertResult, error) {
 	var totalCategories int
-	err := db.QueryRow(`SELECT COUNT(DISTINCT category) FROM prices`).Scan(&totalCategories)
+	err := db.QueryRow(`SELECT COUNT(DISTINCT category) FROM prices WHERE uploaded_by = $1`, userID).Scan(&totalCategories)
 	if err != nil {
 		return nil, fmt.Errorf("error querying total categories: %v", err)
 	}
 
 	var totalPrice float64
-	err = db.QueryRow(`SELECT COALESCE(SUM(price), 0) FROM prices`).Scan(&totalPrice)
+	err = db.QueryRow(`SELECT COALESCE(SUM(price), 0) FROM prices WHERE uploaded_by = $1`, userID).Scan(&totalPrice)
 	if err != nil {
 		return nil, fmt.Errorf("error querying total price: %v", err)
 	}
@@ -298,28 +249,55 @@ func getInsertResult(db *sql.DB, inserted int) (*InsertResult, error) {
 	}, nil
 }
 
-func readFileToBytes(file io.Reader) ([]byte, error) {
-	var buf bytes.Buffer
-	_, err := io.Copy(&buf, file)
-	if err != nil {
-		return nil, err
+// buildPricesQuery translates the `start`, `end`, `min` and `max` query
+// parameters into a parameterized WHERE clause alongside the owner filter.
+func buildPricesQuery(userID int, q map[string][]string) (string, []interface{}, error) {
+	clauses := []string{"uploaded_by = $1"}
+	args := []interface{}{userID}
+
+	add := func(column, op, raw string) {
+		clauses = append(clauses, fmt.Sprintf("%s %s $%d", column, op, len(args)+1))
+		args = append(args, raw)
 	}
-	return buf.Bytes(), nil
-}
 
-func findCSV(zr *zip.Reader) *zip.File {
-	for _, file := range zr.File {
-		if strings.HasSuffix(file.Name, "data.csv") {
-			return file
+	if v := first(q, "start"); v != "" {
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return "", nil, fmt.Errorf("invalid start date %q", v)
+		}
+		add("create_date", ">=", v)
+	}
+	if v := first(q, "end"); v != "" {
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return "", nil, fmt.Errorf("invalid end date %q", v)
+		}
+		add("create_date", "<=", v)
+	}
+	if v := first(q, "min"); v != "" {
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", nil, fmt.Errorf("invalid min price %q", v)
+		}
+		add("price", ">=", v)
+	}
+	if v := first(q, "max"); v != "" {
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", nil, fmt.Errorf("invalid max price %q", v)
 		}
+		add("price", "<=", v)
 	}
-	return nil
+
+	query := fmt.Sprintf(`
+		SELECT id, product_id, name, category, price, create_date
+		FROM prices
+		WHERE %s
+		ORDER BY id ASC
+	`, strings.Join(clauses, " AND "))
+
+	return query, args, nil
 }
 
-func openCSVFromZip(file *zip.File) (*csv.Reader, error) {
-	f, err := file.Open()
-	if err != nil {
-		return nil, err
+func first(q map[string][]string, key string) string {
+	if vals, ok := q[key]; ok && len(vals) > 0 {
+		return vals[0]
 	}
-	return csv.NewReader(f), nil
+	return ""
 }